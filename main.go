@@ -6,12 +6,22 @@ import (
 	"encoding/json"
 	"expvar"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
+	"math/bits"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
+	"github.com/Ilya-Repin/chat-load-testing/scenario"
+	"github.com/gorilla/websocket"
 	"github.com/spf13/afero"
 	"github.com/yandex/pandora/cli"
 	"github.com/yandex/pandora/core"
@@ -21,6 +31,11 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	transportHTTP      = "http"
+	transportWebsocket = "websocket"
+)
+
 //
 // ===== Config =====
 //
@@ -35,6 +50,64 @@ type GunConfig struct {
 	PollStartPath string
 	PollPath      string
 	SendPath      string
+
+	// Transport selects how a gun instance receives messages: "http" (default)
+	// long-polls PollPath, "websocket" opens a single persistent connection
+	// and reads frames as they are pushed by the server.
+	Transport string `validate:"omitempty,oneof=http websocket"`
+
+	// Payload selects the PayloadGenerator used by Shoot. Defaults to "fixed".
+	Payload PayloadConfig
+
+	// DeliveryTimeoutMs is how long the DeliveryTracker waits for a sent
+	// message to be observed before counting it as lost. Defaults to 10s.
+	DeliveryTimeoutMs int `validate:"omitempty,min=1"`
+
+	// HTTPClient parameterizes the *http.Client shared by every gun instance
+	// in this process. Only the first instance to Bind applies it.
+	HTTPClient HTTPClientConfig
+
+	// Retry configures retries for registerUser, pollStart, and the poll GET.
+	Retry RetryConfig
+}
+
+// HTTPClientConfig parameterizes the single *http.Client shared by all gun
+// instances, built once via getHTTPClient.
+type HTTPClientConfig struct {
+	MaxIdleConns        int `validate:"omitempty,min=1"`
+	MaxIdleConnsPerHost int `validate:"omitempty,min=1"`
+	MaxConnsPerHost     int `validate:"omitempty,min=1"`
+}
+
+// RetryConfig bounds retries of idempotent setup/poll requests against
+// transient backend hiccups. A MaxRetries of 0 disables retrying.
+type RetryConfig struct {
+	MaxRetries int `validate:"omitempty,min=0"`
+	BackoffMs  int `validate:"omitempty,min=0"`
+}
+
+// PayloadConfig selects and parameterizes a PayloadGenerator. Only the
+// fields relevant to Type need to be set; the rest are ignored.
+type PayloadConfig struct {
+	Type string `validate:"omitempty,oneof=fixed lognormal-size zipf-recipient template"`
+
+	// Size is the payload size in bytes, used by "fixed". 0 keeps the
+	// historical behaviour of sending the current timestamp.
+	Size int `validate:"omitempty,min=1"`
+
+	// MeanBytes and StddevBytes are the mean and standard deviation, in
+	// log-space, of the "lognormal-size" payload size distribution.
+	MeanBytes   float64 `validate:"omitempty,min=0"`
+	StddevBytes float64 `validate:"omitempty,min=0"`
+
+	// ZipfS and ZipfV parameterize the "zipf-recipient" distribution over
+	// peer indices, per the math/rand.NewZipf convention (s > 1, v >= 1).
+	ZipfS float64 `validate:"omitempty,min=1"`
+	ZipfV float64 `validate:"omitempty,min=1"`
+
+	// Template is a text/template source evaluated against the current
+	// shoot context for the "template" generator.
+	Template string
 }
 
 //
@@ -47,7 +120,592 @@ type User struct {
 	SessionID string
 }
 
-var deliveryLatencyMs = expvar.NewInt("delivery_latency_ms")
+//
+// ===== Latency histogram =====
+//
+
+// deliveryLatency is an HDR-style histogram covering 1ms to 60s with
+// base-2 log buckets split into histSubBuckets linear sub-buckets each
+// (1/128 resolution). It is sharded so that handleMessages, called from
+// every gun instance's poll/read goroutine, can record a value with a
+// single atomic add instead of contending on one shared counter.
+const (
+	histMinMs      = 1
+	histMaxMs      = 60000
+	histSubBuckets = 128
+	histShardCount = 32
+	// histExponents covers floor(log2(histMinMs))..floor(log2(histMaxMs)).
+	histExponents = 16
+	histSlots     = histExponents * histSubBuckets
+)
+
+type histShard struct {
+	counts [histSlots]uint64
+}
+
+type histogram struct {
+	shards [histShardCount]histShard
+}
+
+var deliveryLatency = &histogram{}
+
+// RecordValue adds ms to the shard selected by shardKey (typically the
+// reporting gun instance's ID), using a lock-free atomic increment.
+func (h *histogram) RecordValue(shardKey int, ms int64) {
+	idx := histBucketIndex(ms)
+	shard := &h.shards[shardKey%histShardCount]
+	atomic.AddUint64(&shard.counts[idx], 1)
+}
+
+// merge sums all shards into a single slice of bucket counts.
+func (h *histogram) merge() [histSlots]uint64 {
+	var total [histSlots]uint64
+	for i := range h.shards {
+		for j := range h.shards[i].counts {
+			total[j] += atomic.LoadUint64(&h.shards[i].counts[j])
+		}
+	}
+
+	return total
+}
+
+// histBucketIndex maps a millisecond value to its bucket, clamping to the
+// histogram's [histMinMs, histMaxMs] range. histMaxMs sits below the next
+// power of two, so its own log2 bucket never fills all histSubBuckets
+// sub-buckets; rather than leave that tail permanently dead, every value at
+// or above histMaxMs is routed to the last slot as a dedicated overflow
+// bucket.
+func histBucketIndex(ms int64) int {
+	if ms < histMinMs {
+		ms = histMinMs
+	}
+	if ms >= histMaxMs {
+		return histSlots - 1
+	}
+
+	exp := bits.Len64(uint64(ms)) - 1
+	base := int64(1) << uint(exp)
+	width := float64(base) / float64(histSubBuckets)
+
+	sub := int(float64(ms-base) / width)
+	if sub >= histSubBuckets {
+		sub = histSubBuckets - 1
+	}
+
+	return exp*histSubBuckets + sub
+}
+
+// histBucketMidpoint returns the representative value, in ms, of a bucket
+// index produced by histBucketIndex.
+func histBucketMidpoint(idx int) float64 {
+	exp := idx / histSubBuckets
+	sub := idx % histSubBuckets
+
+	base := float64(int64(1) << uint(exp))
+	width := base / float64(histSubBuckets)
+
+	return base + (float64(sub)+0.5)*width
+}
+
+// histPercentile walks the cumulative distribution to find the value at
+// quantile q (0, 1].
+func histPercentile(counts [histSlots]uint64, total uint64, q float64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(q * float64(total)))
+	if target < 1 {
+		target = 1
+	}
+
+	var cum uint64
+	for idx, c := range counts {
+		cum += c
+		if cum >= target {
+			return histBucketMidpoint(idx)
+		}
+	}
+
+	return histMaxMs
+}
+
+// histSnapshot is the value published under the "delivery_latency" expvar.
+type histSnapshot struct {
+	Count         uint64  `json:"count"`
+	P50Ms         float64 `json:"p50_ms"`
+	P90Ms         float64 `json:"p90_ms"`
+	P99Ms         float64 `json:"p99_ms"`
+	P999Ms        float64 `json:"p999_ms"`
+	RatePerSecond float64 `json:"rate_per_second"`
+}
+
+var latestLatencySnapshot atomic.Value
+
+func init() {
+	latestLatencySnapshot.Store(histSnapshot{})
+
+	expvar.Publish("delivery_latency", expvar.Func(func() any {
+		return latestLatencySnapshot.Load().(histSnapshot)
+	}))
+
+	go mergeLatencyHistogram()
+}
+
+// mergeLatencyHistogram merges the histogram's shards once a second and
+// publishes the resulting percentiles and per-second delivery rate.
+func mergeLatencyHistogram() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastCount uint64
+	for range ticker.C {
+		counts := deliveryLatency.merge()
+
+		var total uint64
+		for _, c := range counts {
+			total += c
+		}
+
+		snapshot := histSnapshot{
+			Count:         total,
+			P50Ms:         histPercentile(counts, total, 0.50),
+			P90Ms:         histPercentile(counts, total, 0.90),
+			P99Ms:         histPercentile(counts, total, 0.99),
+			P999Ms:        histPercentile(counts, total, 0.999),
+			RatePerSecond: float64(total - lastCount),
+		}
+		lastCount = total
+
+		latestLatencySnapshot.Store(snapshot)
+	}
+}
+
+//
+// ===== Delivery tracker =====
+//
+
+const (
+	trackerShardCount    = 64
+	trackerLostSampleCap = 100
+)
+
+var (
+	messagesSent       = expvar.NewInt("messages_sent")
+	messagesDelivered  = expvar.NewInt("messages_delivered")
+	messagesLost       = expvar.NewInt("messages_lost")
+	messagesDuplicated = expvar.NewInt("messages_duplicated")
+	messagesOutOfOrder = expvar.NewInt("messages_out_of_order")
+)
+
+// pendingMessage is a sent message awaiting delivery or timeout.
+type pendingMessage struct {
+	sentAt   time.Time
+	deadline time.Time
+}
+
+// senderState holds per-sender delivery bookkeeping used to detect
+// duplicates and out-of-order arrivals. delivered also records ids that
+// sweepLost already counted as lost, keyed by the time they were recorded,
+// so a late arrival is recognized as a duplicate instead of a fresh
+// delivery; entries older than DeliveryTracker.retention are pruned by
+// sweepLost to keep the map bounded for long-running, high-connection runs.
+type senderState struct {
+	mu        sync.Mutex
+	pending   map[int64]pendingMessage
+	delivered map[int64]time.Time
+	maxSeenID int64
+}
+
+type trackerShard struct {
+	mu      sync.Mutex
+	senders map[string]*senderState
+}
+
+// DeliveryTracker correlates sent messages, identified by (sender, id), with
+// their eventual delivery. It is sharded by sender hash so that 90k
+// concurrently sending connections don't serialize on one global mutex.
+type DeliveryTracker struct {
+	timeout   time.Duration
+	retention time.Duration
+	shards    [trackerShardCount]trackerShard
+
+	lostMu     sync.Mutex
+	lostSample []string
+}
+
+func NewDeliveryTracker(timeout time.Duration) *DeliveryTracker {
+	t := &DeliveryTracker{timeout: timeout, retention: 2 * timeout}
+	for i := range t.shards {
+		t.shards[i].senders = make(map[string]*senderState)
+	}
+
+	return t
+}
+
+func shardIndexFor(sender string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(sender))
+
+	return h.Sum32() % trackerShardCount
+}
+
+func (t *DeliveryTracker) stateFor(sender string) *senderState {
+	shard := &t.shards[shardIndexFor(sender)]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	st, ok := shard.senders[sender]
+	if !ok {
+		st = &senderState{
+			pending:   make(map[int64]pendingMessage),
+			delivered: make(map[int64]time.Time),
+		}
+		shard.senders[sender] = st
+	}
+
+	return st
+}
+
+// Sent registers a message as sent, to be matched against its eventual
+// delivery or timed out by sweepLost.
+func (t *DeliveryTracker) Sent(sender string, id int64, sentAt time.Time) {
+	messagesSent.Add(1)
+
+	st := t.stateFor(sender)
+
+	st.mu.Lock()
+	st.pending[id] = pendingMessage{sentAt: sentAt, deadline: sentAt.Add(t.timeout)}
+	st.mu.Unlock()
+}
+
+// Deliver records the arrival of (sender, id), detecting duplicates and
+// out-of-order delivery, and returns the end-to-end latency since it was
+// sent.
+func (t *DeliveryTracker) Deliver(sender string, id int64, sentAt, now time.Time) time.Duration {
+	st := t.stateFor(sender)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, dup := st.delivered[id]; dup {
+		messagesDuplicated.Add(1)
+		return now.Sub(sentAt)
+	}
+
+	st.delivered[id] = now
+	delete(st.pending, id)
+
+	if id < st.maxSeenID {
+		messagesOutOfOrder.Add(1)
+	}
+	if id > st.maxSeenID {
+		st.maxSeenID = id
+	}
+
+	messagesDelivered.Add(1)
+
+	return now.Sub(sentAt)
+}
+
+// sweepLost scans every shard for sends past their deadline, counts them as
+// lost, and keeps a bounded sample of their ids for the shutdown log. A
+// timed-out id is also recorded in delivered so that, if it arrives late, it
+// is recognized as a duplicate instead of being counted as a fresh delivery.
+// Each pass also prunes delivered entries older than t.retention, bounding
+// the map's size for a long-running, high-connection test.
+func (t *DeliveryTracker) sweepLost() {
+	now := time.Now()
+
+	for i := range t.shards {
+		shard := &t.shards[i]
+
+		shard.mu.Lock()
+		states := make(map[string]*senderState, len(shard.senders))
+		for sender, st := range shard.senders {
+			states[sender] = st
+		}
+		shard.mu.Unlock()
+
+		for sender, st := range states {
+			st.mu.Lock()
+			for id, pm := range st.pending {
+				if now.After(pm.deadline) {
+					delete(st.pending, id)
+					st.delivered[id] = now
+					messagesLost.Add(1)
+					t.recordLostSample(fmt.Sprintf("%s#%d", sender, id))
+				}
+			}
+			for id, at := range st.delivered {
+				if now.Sub(at) > t.retention {
+					delete(st.delivered, id)
+				}
+			}
+			st.mu.Unlock()
+		}
+	}
+}
+
+func (t *DeliveryTracker) recordLostSample(entry string) {
+	t.lostMu.Lock()
+	defer t.lostMu.Unlock()
+
+	if len(t.lostSample) >= trackerLostSampleCap {
+		return
+	}
+	t.lostSample = append(t.lostSample, entry)
+}
+
+// LogLostSample logs the sampled trace of lost message ids. Meant to be
+// called once the load test run has finished.
+func (t *DeliveryTracker) LogLostSample(log *zap.Logger) {
+	t.lostMu.Lock()
+	sample := append([]string(nil), t.lostSample...)
+	t.lostMu.Unlock()
+
+	if len(sample) == 0 {
+		return
+	}
+
+	log.Warn("sampled lost messages",
+		zap.Strings("ids", sample),
+		zap.Int64("total_lost", messagesLost.Value()),
+	)
+}
+
+// run periodically sweeps for timed-out sends until ctx is cancelled.
+func (t *DeliveryTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.sweepLost()
+		}
+	}
+}
+
+var (
+	deliveryTracker     *DeliveryTracker
+	deliveryTrackerOnce sync.Once
+)
+
+// getDeliveryTracker lazily builds the process-wide DeliveryTracker on the
+// first call, using that call's timeout.
+func getDeliveryTracker(timeoutMs int) *DeliveryTracker {
+	deliveryTrackerOnce.Do(func() {
+		timeout := time.Duration(timeoutMs) * time.Millisecond
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+
+		deliveryTracker = NewDeliveryTracker(timeout)
+		go deliveryTracker.run(context.Background())
+	})
+
+	return deliveryTracker
+}
+
+//
+// ===== Payload generators =====
+//
+
+// PayloadGenerator produces the per-message "payload" field and chooses the
+// recipient for one Shoot call. Built-ins are registered with
+// registerPayloadGenerator and selected by GunConfig.Payload.Type.
+type PayloadGenerator interface {
+	// Payload builds the "payload" field value. recipient is whatever
+	// Recipient returned for the same Shoot call, so template-style
+	// generators can reference it.
+	Payload(g *Gun, recipient string) any
+	Recipient(g *Gun) string
+}
+
+// payloadGeneratorFactory builds a PayloadGenerator from its config. g gives
+// generators that need gun-wide state (peer count, prefix, instance ID)
+// access to it; conf is passed explicitly so a generator can be built with
+// config other than g.conf.Payload, as the scenario gun does for the named
+// Payloads its SendSteps select.
+type payloadGeneratorFactory func(conf PayloadConfig, g *Gun) (PayloadGenerator, error)
+
+var payloadGenerators = map[string]payloadGeneratorFactory{}
+
+// registerPayloadGenerator adds a named PayloadGenerator constructor, mirroring
+// the register.Gun pattern used to wire Pandora guns.
+func registerPayloadGenerator(name string, factory payloadGeneratorFactory) {
+	payloadGenerators[name] = factory
+}
+
+func init() {
+	registerPayloadGenerator("fixed", newFixedPayloadGenerator)
+	registerPayloadGenerator("lognormal-size", newLognormalSizePayloadGenerator)
+	registerPayloadGenerator("zipf-recipient", newZipfRecipientPayloadGenerator)
+	registerPayloadGenerator("template", newTemplatePayloadGenerator)
+}
+
+func newPayloadGenerator(conf PayloadConfig, g *Gun) (PayloadGenerator, error) {
+	typ := conf.Type
+	if typ == "" {
+		typ = "fixed"
+	}
+
+	factory, ok := payloadGenerators[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown payload generator type %q", typ)
+	}
+
+	return factory(conf, g)
+}
+
+// fixedPayloadGenerator sends a payload of a constant size, or the current
+// timestamp (the module's historical behaviour) when Size is unset.
+type fixedPayloadGenerator struct {
+	size int
+}
+
+func newFixedPayloadGenerator(conf PayloadConfig, g *Gun) (PayloadGenerator, error) {
+	return &fixedPayloadGenerator{size: conf.Size}, nil
+}
+
+func (p *fixedPayloadGenerator) Payload(g *Gun, recipient string) any {
+	if p.size <= 0 {
+		return strconv.FormatInt(time.Now().UnixMilli(), 10)
+	}
+
+	return strings.Repeat("x", p.size)
+}
+
+func (p *fixedPayloadGenerator) Recipient(g *Gun) string {
+	return g.randomPeer()
+}
+
+// lognormalMaxSizeBytes hard-caps a sampled payload size. Without it, a
+// several-sigma tail sample (or, past mean+stddev*z ~ 709, math.Exp
+// overflowing to +Inf) would ask strings.Repeat for an absurd or even
+// negative count and panic.
+const lognormalMaxSizeBytes = 16 * 1024 * 1024
+
+// lognormalSizePayloadGenerator draws the payload size in bytes from a
+// lognormal distribution, modelling the bursty mix of small texts and large
+// media messages seen in real chat traffic.
+type lognormalSizePayloadGenerator struct {
+	mean, stddev float64
+}
+
+func newLognormalSizePayloadGenerator(conf PayloadConfig, g *Gun) (PayloadGenerator, error) {
+	if conf.MeanBytes > math.Log(lognormalMaxSizeBytes) {
+		return nil, fmt.Errorf(
+			"lognormal-size: mean_bytes %.2f implies a payload size above the %d byte cap",
+			conf.MeanBytes, lognormalMaxSizeBytes,
+		)
+	}
+
+	return &lognormalSizePayloadGenerator{
+		mean:   conf.MeanBytes,
+		stddev: conf.StddevBytes,
+	}, nil
+}
+
+func (p *lognormalSizePayloadGenerator) Payload(g *Gun, recipient string) any {
+	sizeF := math.Exp(rand.NormFloat64()*p.stddev + p.mean)
+	if sizeF < 1 {
+		sizeF = 1
+	}
+	if sizeF > lognormalMaxSizeBytes {
+		sizeF = lognormalMaxSizeBytes
+	}
+
+	return strings.Repeat("x", int(sizeF))
+}
+
+func (p *lognormalSizePayloadGenerator) Recipient(g *Gun) string {
+	return g.randomPeer()
+}
+
+// zipfRecipientPayloadGenerator skews recipient selection towards a small set
+// of "hot" peers instead of randomPeer's uniform pick, approximating chats
+// with a few disproportionately active participants.
+type zipfRecipientPayloadGenerator struct {
+	zipf *rand.Zipf
+}
+
+func newZipfRecipientPayloadGenerator(conf PayloadConfig, g *Gun) (PayloadGenerator, error) {
+	if g.conf.Pollers < 2 {
+		return nil, fmt.Errorf("zipf-recipient requires at least 2 pollers")
+	}
+
+	s := conf.ZipfS
+	if s <= 1 {
+		s = 1.1
+	}
+	v := conf.ZipfV
+	if v < 1 {
+		v = 1
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	return &zipfRecipientPayloadGenerator{
+		zipf: rand.NewZipf(rnd, s, v, uint64(g.conf.Pollers-1)),
+	}, nil
+}
+
+func (p *zipfRecipientPayloadGenerator) Payload(g *Gun, recipient string) any {
+	return strconv.FormatInt(time.Now().UnixMilli(), 10)
+}
+
+func (p *zipfRecipientPayloadGenerator) Recipient(g *Gun) string {
+	for {
+		id := int(p.zipf.Uint64())
+		if id != g.InstanceID {
+			return g.conf.Prefix + strconv.Itoa(id)
+		}
+	}
+}
+
+// templatePayloadGenerator renders the payload from a user-supplied
+// text/template, evaluated against the current shoot context.
+type templatePayloadGenerator struct {
+	tmpl *template.Template
+}
+
+// templateData is the context exposed to the "template" payload generator.
+type templateData struct {
+	Username  string
+	Recipient string
+	Timestamp int64
+}
+
+func newTemplatePayloadGenerator(conf PayloadConfig, g *Gun) (PayloadGenerator, error) {
+	tmpl, err := template.New("payload").Parse(conf.Template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse payload template: %w", err)
+	}
+
+	return &templatePayloadGenerator{tmpl: tmpl}, nil
+}
+
+func (p *templatePayloadGenerator) Payload(g *Gun, recipient string) any {
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, templateData{
+		Username:  g.self.Username,
+		Recipient: recipient,
+		Timestamp: time.Now().UnixMilli(),
+	}); err != nil {
+		g.Log.Debug("failed to render payload template", zap.Error(err))
+	}
+
+	return buf.String()
+}
+
+func (p *templatePayloadGenerator) Recipient(g *Gun) string {
+	return g.randomPeer()
+}
 
 //
 // ===== Gun =====
@@ -60,10 +718,18 @@ type Gun struct {
 
 	client *http.Client
 
+	payloadGen PayloadGenerator
+	tracker    *DeliveryTracker
+	sendSeq    int64
+
 	self User
 
 	ctx  context.Context
 	stop context.CancelFunc
+	done chan struct{}
+
+	wsConn *websocket.Conn
+	wsMu   sync.Mutex
 }
 
 func NewGun(conf GunConfig) *Gun {
@@ -80,16 +746,17 @@ func (g *Gun) Bind(aggr core.Aggregator, deps core.GunDeps) error {
 		time.Sleep(sleepTime)
 	}
 
-	g.client = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConns:        90000,
-			MaxIdleConnsPerHost: 90000,
-			MaxConnsPerHost:     90000,
-		},
-		Timeout: 0,
-	}
+	g.client = getHTTPClient(g.conf.HTTPClient)
 
 	g.ctx, g.stop = context.WithCancel(context.Background())
+	g.done = make(chan struct{})
+
+	gen, err := newPayloadGenerator(g.conf.Payload, g)
+	if err != nil {
+		return err
+	}
+	g.payloadGen = gen
+	g.tracker = getDeliveryTracker(g.conf.DeliveryTimeoutMs)
 
 	user, err := g.registerUser(deps.InstanceID)
 	if err != nil {
@@ -107,30 +774,257 @@ func (g *Gun) Bind(aggr core.Aggregator, deps core.GunDeps) error {
 
 		g.self.SessionID = sid
 
-		go g.pollLoop()
+		if g.conf.Transport == transportWebsocket {
+			if err := g.dialWS(); err != nil {
+				g.Log.Error("failed to dial websocket", zap.Error(err))
+
+				return err
+			}
+
+			go g.wsReadLoop()
+		} else {
+			go g.pollLoop()
+		}
+	} else {
+		close(g.done)
+	}
+
+	return nil
+}
+
+// stopDrainTimeout bounds how long Stop waits for an in-flight poll or
+// websocket read to notice cancellation and return.
+const stopDrainTimeout = 5 * time.Second
+
+// Stop cancels the gun's context and waits, up to stopDrainTimeout, for its
+// poll or websocket read loop to drain and exit.
+func (g *Gun) Stop() error {
+	if g.stop != nil {
+		g.stop()
+	}
+	if g.wsConn != nil {
+		g.wsConn.Close()
+	}
+
+	select {
+	case <-g.done:
+	case <-time.After(stopDrainTimeout):
+		g.Log.Warn("gun stop: timed out draining in-flight requests")
 	}
 
 	return nil
 }
 
+// Close implements io.Closer, which Pandora calls on every gun instance once
+// its shooting schedule finishes.
+func (g *Gun) Close() error {
+	return g.Stop()
+}
+
+var (
+	sharedClient     *http.Client
+	sharedClientOnce sync.Once
+)
+
+// getHTTPClient returns the *http.Client shared by every gun instance in
+// this process, building it from conf on the first call. Later calls reuse
+// the same client regardless of conf, since the transport's connection pool
+// is process-wide.
+func getHTTPClient(conf HTTPClientConfig) *http.Client {
+	sharedClientOnce.Do(func() {
+		maxIdleConns := conf.MaxIdleConns
+		if maxIdleConns == 0 {
+			maxIdleConns = 90000
+		}
+		maxIdleConnsPerHost := conf.MaxIdleConnsPerHost
+		if maxIdleConnsPerHost == 0 {
+			maxIdleConnsPerHost = 90000
+		}
+		maxConnsPerHost := conf.MaxConnsPerHost
+		if maxConnsPerHost == 0 {
+			maxConnsPerHost = 90000
+		}
+
+		sharedClient = &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConns:        maxIdleConns,
+				MaxIdleConnsPerHost: maxIdleConnsPerHost,
+				MaxConnsPerHost:     maxConnsPerHost,
+			},
+			Timeout: 0,
+		}
+	})
+
+	return sharedClient
+}
+
+// withRetry runs do, retrying up to conf.MaxRetries times, pausing
+// conf.BackoffMs between attempts. It retries only on a transport error or a
+// 5xx response; a successful or 4xx response is returned immediately.
+func withRetry(conf RetryConfig, do func() (*http.Response, error)) (*http.Response, error) {
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	for attempt := 0; attempt <= conf.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(conf.BackoffMs) * time.Millisecond)
+		}
+
+		resp, err = do()
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		// Only close the body of a response we're about to discard and
+		// retry past; the one we ultimately return must stay open for the
+		// caller to read.
+		if err == nil && attempt < conf.MaxRetries {
+			resp.Body.Close()
+		}
+	}
+
+	return resp, err
+}
+
+//
+// ===== WebSocket transport =====
+//
+
+// dialWS opens the persistent subscription connection used when
+// conf.Transport is "websocket" and reports the handshake as proto code 101.
+func (g *Gun) dialWS() error {
+	wsURL, err := wsURLFor(g.conf.Target, g.conf.PollPath, g.self.Token)
+	if err != nil {
+		return err
+	}
+
+	sample := netsample.Acquire("ws_handshake")
+	conn, resp, err := websocket.DefaultDialer.DialContext(g.ctx, wsURL, nil)
+	defer g.aggr.Report(sample)
+
+	if err != nil {
+		sample.SetProtoCode(0)
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	sample.SetProtoCode(101)
+
+	g.wsConn = conn
+
+	return nil
+}
+
+// wsURLFor rewrites the HTTP(S) target into the matching ws(s):// URL and
+// attaches the session token as a query parameter.
+func wsURLFor(target, path, token string) (string, error) {
+	u, err := url.Parse(target + path)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse target url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// wsReadLoop decodes message frames pushed over the socket and feeds them to
+// handleMessages, reporting each frame as proto code 200.
+func (g *Gun) wsReadLoop() {
+	defer close(g.done)
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		default:
+		}
+
+		_, frame, err := g.wsConn.ReadMessage()
+		sample := netsample.Acquire("ws_frame")
+
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				g.Log.Debug("failed to read ws frame", zap.Error(err))
+			}
+			sample.SetProtoCode(0)
+			g.aggr.Report(sample)
+
+			return
+		}
+
+		sample.SetProtoCode(200)
+		g.aggr.Report(sample)
+
+		g.handleMessages(bytes.NewReader(frame))
+	}
+}
+
 //
 // ===== Shoot =====
 //
 
 func (g *Gun) Shoot(ammo core.Ammo) {
-	receiver := g.randomPeer()
-	ts := time.Now().UnixMilli()
+	data := g.buildAndTrackMessage(g.payloadGen)
 
+	if g.conf.Transport == transportWebsocket && g.wsConn != nil {
+		g.shootWS(data)
+		return
+	}
+
+	g.sendHTTP(data)
+}
+
+// buildAndTrackMessage builds one message via gen, assigns it the sender's
+// next monotonic id, registers it with the delivery tracker, and returns its
+// marshalled JSON body.
+func (g *Gun) buildAndTrackMessage(gen PayloadGenerator) []byte {
+	receiver := gen.Recipient(g)
+	payload := gen.Payload(g, receiver)
+
+	id := atomic.AddInt64(&g.sendSeq, 1)
+	sentAt := time.Now()
+
+	g.tracker.Sent(g.self.Username, id, sentAt)
+
+	return marshalMessage(receiver, g.self.Username, id, sentAt.UnixMilli(), payload)
+}
+
+// marshalMessage builds the JSON message body that Shoot and the scenario
+// gun's SendStep post to SendPath, or that Shoot writes to the websocket in
+// websocket mode.
+func marshalMessage(recipient, sender string, id, sentAt int64, payload any) []byte {
 	body := map[string]any{
 		"message": map[string]any{
-			"recipient": receiver,
-			"payload":   strconv.FormatInt(ts, 10),
+			"recipient": recipient,
+			"sender":    sender,
+			"id":        id,
+			"sent_at":   sentAt,
+			"payload":   payload,
 		},
 	}
 
 	data, _ := json.Marshal(body)
 
-	req, _ := http.NewRequest(
+	return data
+}
+
+// sendHTTP posts a pre-marshalled message body to SendPath, reporting under
+// the "send" tag.
+func (g *Gun) sendHTTP(data []byte) {
+	req, _ := http.NewRequestWithContext(
+		g.ctx,
 		"POST",
 		g.conf.Target+g.conf.SendPath,
 		bytes.NewReader(data),
@@ -151,11 +1045,30 @@ func (g *Gun) Shoot(ammo core.Ammo) {
 	defer resp.Body.Close()
 }
 
+// shootWS sends the message over the persistent websocket connection rather
+// than issuing an HTTP POST, used when conf.Transport is "websocket".
+func (g *Gun) shootWS(data []byte) {
+	sample := netsample.Acquire("send_ws")
+	defer g.aggr.Report(sample)
+
+	g.wsMu.Lock()
+	err := g.wsConn.WriteMessage(websocket.TextMessage, data)
+	g.wsMu.Unlock()
+
+	if err != nil {
+		sample.SetProtoCode(0)
+		return
+	}
+	sample.SetProtoCode(200)
+}
+
 //
 // ===== Polling =====
 //
 
 func (g *Gun) pollLoop() {
+	defer close(g.done)
+
 	for {
 		randomMillis := rand.Intn(101-10) + 10
 		pauseDuration := time.Duration(randomMillis) * time.Millisecond
@@ -167,7 +1080,8 @@ func (g *Gun) pollLoop() {
 		}
 
 		func() {
-			req, _ := http.NewRequest(
+			req, _ := http.NewRequestWithContext(
+				g.ctx,
 				"GET",
 				g.conf.Target+g.conf.PollPath+"/"+g.self.SessionID,
 				nil,
@@ -177,7 +1091,9 @@ func (g *Gun) pollLoop() {
 			sample := netsample.Acquire("poll")
 			defer g.aggr.Report(sample)
 
-			resp, err := g.client.Do(req)
+			resp, err := withRetry(g.conf.Retry, func() (*http.Response, error) {
+				return g.client.Do(req)
+			})
 			if err != nil {
 				g.Log.Error("failed to poll", zap.Error(err))
 				sample.SetProtoCode(0)
@@ -194,34 +1110,44 @@ func (g *Gun) pollLoop() {
 	}
 }
 
-func (g *Gun) handleMessages(r io.Reader) {
+// handleMessages parses a poll response or websocket frame, feeds each
+// message to the delivery tracker, and returns how many it matched. Callers
+// that need to know whether anything actually arrived (e.g. AwaitDelivery)
+// use that count instead of assuming a 200 status means a message was
+// delivered.
+func (g *Gun) handleMessages(r io.Reader) int {
 	body, err := io.ReadAll(r)
 	if err != nil {
 		g.Log.Error("failed to read body", zap.Error(err))
-		return
+		return 0
 	}
 
 	var out struct {
 		Messages []struct {
-			Text string `json:"text"`
+			Sender string `json:"sender"`
+			ID     int64  `json:"id"`
+			SentAt int64  `json:"sent_at"`
 		} `json:"messages"`
 	}
 
 	if err := json.Unmarshal(body, &out); err != nil {
 		g.Log.Debug("failed to unmarshal json", zap.Error(err))
-		return
+		return 0
 	}
 
+	matched := 0
 	now := time.Now()
 	for _, m := range out.Messages {
-		ts, err := strconv.ParseInt(m.Text, 10, 64)
-		if err != nil {
+		if m.Sender == "" {
 			continue
 		}
 
-		e2e := now.Sub(time.UnixMilli(ts)).Milliseconds()
-		deliveryLatencyMs.Add(e2e)
+		e2e := g.tracker.Deliver(m.Sender, m.ID, time.UnixMilli(m.SentAt), now)
+		deliveryLatency.RecordValue(g.InstanceID, e2e.Milliseconds())
+		matched++
 	}
+
+	return matched
 }
 
 //
@@ -251,11 +1177,17 @@ func (g *Gun) registerUser(instance int) (User, error) {
 
 	data, _ := json.Marshal(body)
 
-	resp, err := g.client.Post(
-		g.conf.Target+g.conf.RegisterPath,
-		"application/json",
-		bytes.NewReader(data),
-	)
+	resp, err := withRetry(g.conf.Retry, func() (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(
+			g.ctx,
+			"POST",
+			g.conf.Target+g.conf.RegisterPath,
+			bytes.NewReader(data),
+		)
+		req.Header.Set("Content-Type", "application/json")
+
+		return g.client.Do(req)
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -282,14 +1214,17 @@ func (g *Gun) registerUser(instance int) (User, error) {
 }
 
 func (g *Gun) pollStart(u User) (string, error) {
-	req, _ := http.NewRequest(
+	req, _ := http.NewRequestWithContext(
+		g.ctx,
 		"POST",
 		g.conf.Target+g.conf.PollStartPath,
 		nil,
 	)
 	req.Header.Set("Authorization", "Bearer "+u.Token)
 
-	resp, err := g.client.Do(req)
+	resp, err := withRetry(g.conf.Retry, func() (*http.Response, error) {
+		return g.client.Do(req)
+	})
 	if err != nil {
 		return "", err
 	}
@@ -303,6 +1238,229 @@ func (g *Gun) pollStart(u User) (string, error) {
 	return out.SessionID, nil
 }
 
+//
+// ===== Scenario gun =====
+//
+
+// ScenarioGunConfig configures chat-scenario-gun: a gun that, instead of
+// repeating one fixed action, drives a scripted multi-step user journey
+// (register, poll, send, await delivery, logout) once per Shoot call.
+type ScenarioGunConfig struct {
+	GunConfig `mapstructure:",squash"`
+
+	LogoutPath string `validate:"required"`
+
+	// Payloads are additional named PayloadGenerator configs a SendStep can
+	// select via PayloadRef, on top of GunConfig.Payload (the default).
+	Payloads map[string]PayloadConfig
+
+	Scenario scenario.Scenario `validate:"required"`
+}
+
+// ScenarioGun runs scenario.Scenario's steps against the same HTTP client
+// and user state as Gun, reusing Gun's connection setup and helpers.
+type ScenarioGun struct {
+	Gun
+
+	scenarioConf ScenarioGunConfig
+	steps        []scenario.Step
+	payloadGens  map[string]PayloadGenerator
+}
+
+func NewScenarioGun(conf ScenarioGunConfig) *ScenarioGun {
+	return &ScenarioGun{
+		Gun:          Gun{conf: conf.GunConfig},
+		scenarioConf: conf,
+	}
+}
+
+func (sg *ScenarioGun) Bind(aggr core.Aggregator, deps core.GunDeps) error {
+	sg.aggr = aggr
+	sg.GunDeps = deps
+
+	sg.client = getHTTPClient(sg.conf.HTTPClient)
+
+	sg.ctx, sg.stop = context.WithCancel(context.Background())
+	sg.done = make(chan struct{})
+	close(sg.done)
+
+	gen, err := newPayloadGenerator(sg.conf.Payload, &sg.Gun)
+	if err != nil {
+		return err
+	}
+	sg.payloadGen = gen
+	sg.tracker = getDeliveryTracker(sg.conf.DeliveryTimeoutMs)
+
+	sg.payloadGens = make(map[string]PayloadGenerator, len(sg.scenarioConf.Payloads))
+	for name, conf := range sg.scenarioConf.Payloads {
+		gen, err := newPayloadGenerator(conf, &sg.Gun)
+		if err != nil {
+			return fmt.Errorf("payload %q: %w", name, err)
+		}
+
+		sg.payloadGens[name] = gen
+	}
+
+	steps, err := sg.scenarioConf.Scenario.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build scenario: %w", err)
+	}
+	sg.steps = steps
+
+	return nil
+}
+
+func (sg *ScenarioGun) Shoot(ammo core.Ammo) {
+	exec := &scenarioExecutor{
+		gun:         &sg.Gun,
+		payloadGens: sg.payloadGens,
+		logoutPath:  sg.scenarioConf.LogoutPath,
+	}
+
+	if err := scenario.Run(exec, sg.steps); err != nil {
+		sg.Log.Error("scenario run failed", zap.Error(err))
+	}
+}
+
+// scenarioExecutor implements scenario.Executor on top of a Gun's HTTP
+// client, user state, and reporting, tagging each sample with the step name.
+type scenarioExecutor struct {
+	gun         *Gun
+	payloadGens map[string]PayloadGenerator
+	logoutPath  string
+}
+
+func (e *scenarioExecutor) Register() error {
+	sample := netsample.Acquire("register")
+	defer e.gun.aggr.Report(sample)
+
+	user, err := e.gun.registerUser(e.gun.InstanceID)
+	if err != nil {
+		sample.SetProtoCode(0)
+		return err
+	}
+
+	sample.SetProtoCode(200)
+	e.gun.self = user
+
+	return nil
+}
+
+func (e *scenarioExecutor) PollStart() error {
+	sample := netsample.Acquire("poll_start")
+	defer e.gun.aggr.Report(sample)
+
+	sid, err := e.gun.pollStart(e.gun.self)
+	if err != nil {
+		sample.SetProtoCode(0)
+		return err
+	}
+
+	sample.SetProtoCode(200)
+	e.gun.self.SessionID = sid
+
+	return nil
+}
+
+func (e *scenarioExecutor) Send(count int, ratePerSec float64, payloadRef string) error {
+	gen := e.gun.payloadGen
+	if payloadRef != "" {
+		if named, ok := e.payloadGens[payloadRef]; ok {
+			gen = named
+		}
+	}
+
+	var interval time.Duration
+	if ratePerSec > 0 {
+		interval = time.Duration(float64(time.Second) / ratePerSec)
+	}
+
+	for i := 0; i < count; i++ {
+		e.gun.sendHTTP(e.gun.buildAndTrackMessage(gen))
+
+		if interval > 0 && i < count-1 {
+			time.Sleep(interval)
+		}
+	}
+
+	return nil
+}
+
+// AwaitDelivery polls until at least one message is actually matched by
+// handleMessages, not merely until a poll returns HTTP 200 — a long-poll
+// routinely answers 200 with an empty "messages" array while nothing has
+// arrived yet, which would otherwise make this a no-op.
+func (e *scenarioExecutor) AwaitDelivery(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		req, _ := http.NewRequestWithContext(
+			e.gun.ctx,
+			"GET",
+			e.gun.conf.Target+e.gun.conf.PollPath+"/"+e.gun.self.SessionID,
+			nil,
+		)
+		req.Header.Set("Authorization", "Bearer "+e.gun.self.Token)
+
+		sample := netsample.Acquire("await_delivery")
+		resp, err := e.gun.client.Do(req)
+		if err != nil {
+			sample.SetProtoCode(0)
+			e.gun.aggr.Report(sample)
+
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+
+		sample.SetProtoCode(resp.StatusCode)
+		e.gun.aggr.Report(sample)
+
+		if resp.StatusCode == http.StatusOK {
+			matched := e.gun.handleMessages(resp.Body)
+			resp.Body.Close()
+
+			if matched > 0 {
+				return nil
+			}
+
+			continue
+		}
+		resp.Body.Close()
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return fmt.Errorf("delivery await timed out after %s", timeout)
+}
+
+func (e *scenarioExecutor) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (e *scenarioExecutor) Logout() error {
+	req, _ := http.NewRequestWithContext(
+		e.gun.ctx,
+		"POST",
+		e.gun.conf.Target+e.logoutPath,
+		nil,
+	)
+	req.Header.Set("Authorization", "Bearer "+e.gun.self.Token)
+
+	sample := netsample.Acquire("logout")
+	resp, err := e.gun.client.Do(req)
+	defer e.gun.aggr.Report(sample)
+
+	if err != nil {
+		sample.SetProtoCode(0)
+		return err
+	}
+	defer resp.Body.Close()
+
+	sample.SetProtoCode(resp.StatusCode)
+
+	return nil
+}
+
 //
 // ===== main =====
 //
@@ -319,8 +1477,36 @@ func main() {
 			PollStartPath: "/v1/messages/poll/start",
 			PollPath:      "/v1/messages/poll",
 			SendPath:      "/v1/messages/send",
+			Transport:     transportHTTP,
+		}
+	})
+
+	register.Gun("chat-gun-ws", NewGun, func() GunConfig {
+		return GunConfig{
+			RegisterPath:  "/v1/users/register",
+			PollStartPath: "/v1/messages/poll/start",
+			PollPath:      "/v1/messages/subscribe",
+			SendPath:      "/v1/messages/send",
+			Transport:     transportWebsocket,
+		}
+	})
+
+	register.Gun("chat-scenario-gun", NewScenarioGun, func() ScenarioGunConfig {
+		return ScenarioGunConfig{
+			GunConfig: GunConfig{
+				RegisterPath:  "/v1/users/register",
+				PollStartPath: "/v1/messages/poll/start",
+				PollPath:      "/v1/messages/poll",
+				SendPath:      "/v1/messages/send",
+				Transport:     transportHTTP,
+			},
+			LogoutPath: "/v1/users/logout",
 		}
 	})
 
 	cli.Run()
+
+	if deliveryTracker != nil {
+		deliveryTracker.LogLostSample(zap.L())
+	}
 }
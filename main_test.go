@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveryTrackerDeliverCountsDuplicates(t *testing.T) {
+	tr := NewDeliveryTracker(time.Second)
+	sentAt := time.Now()
+
+	tr.Sent("alice", 1, sentAt)
+	tr.Deliver("alice", 1, sentAt, sentAt.Add(10*time.Millisecond))
+
+	before := messagesDuplicated.Value()
+	tr.Deliver("alice", 1, sentAt, sentAt.Add(20*time.Millisecond))
+
+	if got := messagesDuplicated.Value(); got != before+1 {
+		t.Errorf("messages_duplicated = %d, want %d", got, before+1)
+	}
+}
+
+func TestDeliveryTrackerDeliverDetectsOutOfOrder(t *testing.T) {
+	tr := NewDeliveryTracker(time.Second)
+	sentAt := time.Now()
+
+	tr.Sent("bob", 5, sentAt)
+	tr.Sent("bob", 3, sentAt)
+	tr.Deliver("bob", 5, sentAt, sentAt)
+
+	before := messagesOutOfOrder.Value()
+	tr.Deliver("bob", 3, sentAt, sentAt)
+
+	if got := messagesOutOfOrder.Value(); got != before+1 {
+		t.Errorf("messages_out_of_order = %d, want %d", got, before+1)
+	}
+}
+
+// TestDeliveryTrackerLateArrivalAfterSweepIsNotDoubleCounted verifies that a
+// message already swept as lost is not later counted as delivered too, were
+// it to arrive after the fact.
+func TestDeliveryTrackerLateArrivalAfterSweepIsNotDoubleCounted(t *testing.T) {
+	tr := NewDeliveryTracker(10 * time.Millisecond)
+	sentAt := time.Now().Add(-time.Hour)
+
+	tr.Sent("carol", 1, sentAt)
+
+	lostBefore := messagesLost.Value()
+	tr.sweepLost()
+	if got := messagesLost.Value(); got != lostBefore+1 {
+		t.Fatalf("messages_lost = %d, want %d", got, lostBefore+1)
+	}
+
+	deliveredBefore := messagesDelivered.Value()
+	duplicatedBefore := messagesDuplicated.Value()
+	tr.Deliver("carol", 1, sentAt, time.Now())
+
+	if got := messagesDelivered.Value(); got != deliveredBefore {
+		t.Errorf("messages_delivered = %d, want unchanged %d (late arrival after sweep must not count as fresh delivery)", got, deliveredBefore)
+	}
+	if got := messagesDuplicated.Value(); got != duplicatedBefore+1 {
+		t.Errorf("messages_duplicated = %d, want %d", got, duplicatedBefore+1)
+	}
+}
+
+// TestDeliveryTrackerSweepLostPrunesOldDeliveredEntries verifies delivered
+// entries are eventually forgotten so a long-running sender's bookkeeping
+// doesn't grow without bound.
+func TestDeliveryTrackerSweepLostPrunesOldDeliveredEntries(t *testing.T) {
+	tr := NewDeliveryTracker(10 * time.Millisecond)
+	sentAt := time.Now()
+
+	tr.Sent("dave", 1, sentAt)
+	tr.Deliver("dave", 1, sentAt, sentAt)
+
+	st := tr.stateFor("dave")
+	st.mu.Lock()
+	st.delivered[1] = time.Now().Add(-tr.retention - time.Second)
+	st.mu.Unlock()
+
+	tr.sweepLost()
+
+	st.mu.Lock()
+	_, stillPresent := st.delivered[1]
+	st.mu.Unlock()
+
+	if stillPresent {
+		t.Error("delivered entry older than retention was not pruned")
+	}
+}
+
+func TestHistBucketIndexClampsToRange(t *testing.T) {
+	if got := histBucketIndex(-5); got != histBucketIndex(histMinMs) {
+		t.Errorf("histBucketIndex(-5) = %d, want clamped to histMinMs bucket %d", got, histBucketIndex(histMinMs))
+	}
+	if got, want := histBucketIndex(histMaxMs*10), histSlots-1; got != want {
+		t.Errorf("histBucketIndex(above max) = %d, want top bucket %d", got, want)
+	}
+}
+
+func TestHistBucketIndexMonotonic(t *testing.T) {
+	prev := histBucketIndex(histMinMs)
+	for ms := int64(histMinMs); ms <= histMaxMs; ms *= 2 {
+		idx := histBucketIndex(ms)
+		if idx < prev {
+			t.Fatalf("histBucketIndex(%d) = %d, went backwards from %d", ms, idx, prev)
+		}
+		prev = idx
+	}
+}
+
+func TestHistBucketMidpointRoundTrip(t *testing.T) {
+	// 59999 is deliberately excluded: its own bucket's midpoint lands above
+	// histMaxMs, which is expected to round-trip into the dedicated
+	// overflow bucket rather than back to the same index.
+	for _, ms := range []int64{1, 2, 100, 1000, 30000} {
+		idx := histBucketIndex(ms)
+		mid := histBucketMidpoint(idx)
+
+		if histBucketIndex(int64(mid)) != idx {
+			t.Errorf("histBucketMidpoint(histBucketIndex(%d))=%v maps back to a different bucket", ms, mid)
+		}
+	}
+}
+
+func TestHistBucketIndexOverflowBucketRoundTrips(t *testing.T) {
+	idx := histBucketIndex(histMaxMs)
+	if idx != histSlots-1 {
+		t.Fatalf("histBucketIndex(histMaxMs) = %d, want overflow bucket %d", idx, histSlots-1)
+	}
+
+	mid := histBucketMidpoint(idx)
+	if histBucketIndex(int64(mid)) != idx {
+		t.Errorf("overflow bucket's own midpoint %v did not round-trip back to it", mid)
+	}
+}
+
+func TestHistPercentile(t *testing.T) {
+	var counts [histSlots]uint64
+	counts[histBucketIndex(10)] = 90
+	counts[histBucketIndex(1000)] = 10
+
+	total := uint64(100)
+
+	if p50 := histPercentile(counts, total, 0.50); p50 >= 1000 {
+		t.Errorf("p50 = %v, want within the 10ms bucket", p50)
+	}
+	if p99 := histPercentile(counts, total, 0.99); p99 < 1000 {
+		t.Errorf("p99 = %v, want within the 1000ms bucket", p99)
+	}
+}
+
+func TestHistPercentileEmpty(t *testing.T) {
+	var counts [histSlots]uint64
+	if got := histPercentile(counts, 0, 0.50); got != 0 {
+		t.Errorf("histPercentile with no samples = %v, want 0", got)
+	}
+}
+
+func TestNewLognormalSizePayloadGeneratorRejectsHugeMean(t *testing.T) {
+	_, err := newLognormalSizePayloadGenerator(PayloadConfig{MeanBytes: 1000}, nil)
+	if err == nil {
+		t.Fatal("expected an error for a mean_bytes that implies a payload above the cap, got nil")
+	}
+}
+
+func TestLognormalSizePayloadGeneratorPayloadNeverExceedsCap(t *testing.T) {
+	gen, err := newLognormalSizePayloadGenerator(PayloadConfig{MeanBytes: 10, StddevBytes: 20}, nil)
+	if err != nil {
+		t.Fatalf("newLognormalSizePayloadGenerator returned error: %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		payload, ok := gen.Payload(nil, "").(string)
+		if !ok {
+			t.Fatalf("Payload() returned %T, want string", payload)
+		}
+		if len(payload) < 1 || len(payload) > lognormalMaxSizeBytes {
+			t.Fatalf("Payload() length %d outside [1, %d]", len(payload), lognormalMaxSizeBytes)
+		}
+	}
+}
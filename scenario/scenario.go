@@ -0,0 +1,172 @@
+// Package scenario implements a small DSL for scripting multi-step chat user
+// journeys (register, poll, send, wait, logout) so a single gun can drive a
+// realistic session instead of one fixed action per shoot.
+package scenario
+
+import (
+	"fmt"
+	"time"
+)
+
+//
+// ===== Steps =====
+//
+
+// Step is implemented by every typed step produced from a StepConfig.
+type Step interface {
+	Name() string
+}
+
+// RegisterStep creates the chat user that will run the rest of the scenario.
+type RegisterStep struct{}
+
+func (RegisterStep) Name() string { return "register" }
+
+// PollStartStep opens the polling session used by AwaitDeliveryStep.
+type PollStartStep struct{}
+
+func (PollStartStep) Name() string { return "poll_start" }
+
+// SendStep sends Count messages at RatePerSec, optionally using the payload
+// generator named by PayloadRef instead of the gun's default one.
+type SendStep struct {
+	Count      int
+	RatePerSec float64
+	PayloadRef string
+}
+
+func (SendStep) Name() string { return "send" }
+
+// AwaitDeliveryStep blocks until a message is observed or TimeoutMs elapses.
+type AwaitDeliveryStep struct {
+	TimeoutMs int
+}
+
+func (AwaitDeliveryStep) Name() string { return "await_delivery" }
+
+// SleepStep pauses the scenario for DurationMs, e.g. to simulate idle time
+// between bursts of activity.
+type SleepStep struct {
+	DurationMs int
+}
+
+func (SleepStep) Name() string { return "sleep" }
+
+// LogoutStep ends the user's session.
+type LogoutStep struct{}
+
+func (LogoutStep) Name() string { return "logout" }
+
+//
+// ===== Config =====
+//
+
+// StepConfig is the raw config representation of one scenario step, as
+// decoded from the gun's YAML config. Only the fields relevant to Type need
+// to be set.
+type StepConfig struct {
+	Type string `validate:"required,oneof=register poll_start send await_delivery sleep logout"`
+
+	Count      int     `validate:"omitempty,min=1"`
+	RatePerSec float64 `validate:"omitempty,min=0"`
+	PayloadRef string
+
+	TimeoutMs  int `validate:"omitempty,min=1"`
+	DurationMs int `validate:"omitempty,min=1"`
+}
+
+// defaultAwaitDeliveryTimeoutMs is used when an await_delivery step omits
+// TimeoutMs, mirroring the 10s fallback the gun's own DeliveryTimeoutMs
+// applies when left unset.
+const defaultAwaitDeliveryTimeoutMs = 10000
+
+func (c StepConfig) build() (Step, error) {
+	switch c.Type {
+	case "register":
+		return RegisterStep{}, nil
+	case "poll_start":
+		return PollStartStep{}, nil
+	case "send":
+		return SendStep{Count: c.Count, RatePerSec: c.RatePerSec, PayloadRef: c.PayloadRef}, nil
+	case "await_delivery":
+		timeoutMs := c.TimeoutMs
+		if timeoutMs <= 0 {
+			timeoutMs = defaultAwaitDeliveryTimeoutMs
+		}
+
+		return AwaitDeliveryStep{TimeoutMs: timeoutMs}, nil
+	case "sleep":
+		return SleepStep{DurationMs: c.DurationMs}, nil
+	case "logout":
+		return LogoutStep{}, nil
+	default:
+		return nil, fmt.Errorf("unknown scenario step type %q", c.Type)
+	}
+}
+
+// Scenario is an ordered list of steps describing one chat user journey,
+// e.g. register -> poll_start -> send -> await_delivery -> logout.
+type Scenario struct {
+	Steps []StepConfig `validate:"required,min=1,dive"`
+}
+
+// Build converts the raw step configs into typed, executable steps.
+func (s Scenario) Build() ([]Step, error) {
+	steps := make([]Step, 0, len(s.Steps))
+
+	for i, c := range s.Steps {
+		step, err := c.build()
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+//
+// ===== Execution =====
+//
+
+// Executor performs the side effects of each step type. The gun that owns
+// the scenario implements it, reusing its own HTTP client and reporting.
+type Executor interface {
+	Register() error
+	PollStart() error
+	Send(count int, ratePerSec float64, payloadRef string) error
+	AwaitDelivery(timeout time.Duration) error
+	Sleep(d time.Duration)
+	Logout() error
+}
+
+// Run executes steps against exec in order, stopping at the first error.
+func Run(exec Executor, steps []Step) error {
+	for _, step := range steps {
+		var err error
+
+		switch s := step.(type) {
+		case RegisterStep:
+			err = exec.Register()
+		case PollStartStep:
+			err = exec.PollStart()
+		case SendStep:
+			err = exec.Send(s.Count, s.RatePerSec, s.PayloadRef)
+		case AwaitDeliveryStep:
+			err = exec.AwaitDelivery(time.Duration(s.TimeoutMs) * time.Millisecond)
+		case SleepStep:
+			exec.Sleep(time.Duration(s.DurationMs) * time.Millisecond)
+		case LogoutStep:
+			err = exec.Logout()
+		default:
+			err = fmt.Errorf("unsupported scenario step %T", step)
+		}
+
+		if err != nil {
+			return fmt.Errorf("step %q failed: %w", step.Name(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package scenario
+
+import "testing"
+
+func TestStepConfigBuild(t *testing.T) {
+	cases := []struct {
+		name string
+		conf StepConfig
+		want Step
+	}{
+		{"register", StepConfig{Type: "register"}, RegisterStep{}},
+		{"poll_start", StepConfig{Type: "poll_start"}, PollStartStep{}},
+		{
+			"send",
+			StepConfig{Type: "send", Count: 5, RatePerSec: 2.5, PayloadRef: "burst"},
+			SendStep{Count: 5, RatePerSec: 2.5, PayloadRef: "burst"},
+		},
+		{
+			"await_delivery",
+			StepConfig{Type: "await_delivery", TimeoutMs: 3000},
+			AwaitDeliveryStep{TimeoutMs: 3000},
+		},
+		{
+			"sleep",
+			StepConfig{Type: "sleep", DurationMs: 500},
+			SleepStep{DurationMs: 500},
+		},
+		{"logout", StepConfig{Type: "logout"}, LogoutStep{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.conf.build()
+			if err != nil {
+				t.Fatalf("build() returned error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("build() = %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStepConfigBuildUnknownType(t *testing.T) {
+	_, err := StepConfig{Type: "teleport"}.build()
+	if err == nil {
+		t.Fatal("expected an error for an unknown step type, got nil")
+	}
+}
+
+func TestStepConfigBuildAwaitDeliveryDefaultsTimeout(t *testing.T) {
+	step, err := StepConfig{Type: "await_delivery"}.build()
+	if err != nil {
+		t.Fatalf("build() returned error: %v", err)
+	}
+
+	got, ok := step.(AwaitDeliveryStep)
+	if !ok {
+		t.Fatalf("build() = %#v, want an AwaitDeliveryStep", step)
+	}
+	if got.TimeoutMs != defaultAwaitDeliveryTimeoutMs {
+		t.Errorf("TimeoutMs = %d, want the default %d", got.TimeoutMs, defaultAwaitDeliveryTimeoutMs)
+	}
+}
+
+func TestScenarioBuild(t *testing.T) {
+	s := Scenario{Steps: []StepConfig{
+		{Type: "register"},
+		{Type: "poll_start"},
+		{Type: "send", Count: 3},
+		{Type: "await_delivery", TimeoutMs: 1000},
+		{Type: "logout"},
+	}}
+
+	steps, err := s.Build()
+	if err != nil {
+		t.Fatalf("Build() returned error: %v", err)
+	}
+	if len(steps) != len(s.Steps) {
+		t.Fatalf("Build() returned %d steps, want %d", len(steps), len(s.Steps))
+	}
+
+	names := []string{"register", "poll_start", "send", "await_delivery", "logout"}
+	for i, step := range steps {
+		if step.Name() != names[i] {
+			t.Errorf("step %d: Name() = %q, want %q", i, step.Name(), names[i])
+		}
+	}
+}
+
+func TestScenarioBuildPropagatesStepError(t *testing.T) {
+	s := Scenario{Steps: []StepConfig{
+		{Type: "register"},
+		{Type: "teleport"},
+	}}
+
+	if _, err := s.Build(); err == nil {
+		t.Fatal("expected an error from the invalid step, got nil")
+	}
+}